@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"gocloud.dev/blob"
+	_ "gocloud.dev/blob/azureblob"
+	_ "gocloud.dev/blob/fileblob"
+	_ "gocloud.dev/blob/gcsblob"
+	"gocloud.dev/blob/s3blob"
+)
+
+// OpenBucket opens bucketURL via gocloud.dev/blob, so Sync can target any
+// registered driver (s3://, gs://, azblob://, file://) the same way. For the
+// S3 driver, partSize and concurrencyPerFile (when non-zero) are forwarded
+// to the underlying s3manager.Uploader.
+func OpenBucket(ctx context.Context, bucketURL string, partSize int64, concurrencyPerFile int) (*blob.Bucket, error) {
+	if IsS3Bucket(bucketURL) {
+		return openS3Bucket(ctx, bucketURL, partSize, concurrencyPerFile)
+	}
+	return blob.OpenBucket(ctx, bucketURL)
+}
+
+func openS3Bucket(ctx context.Context, bucketURL string, partSize int64, concurrencyPerFile int) (*blob.Bucket, error) {
+	u, err := url.Parse(bucketURL)
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(u.Query().Get("region"))})
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &s3blob.Options{
+		Uploader: func(uploader *s3manager.Uploader) {
+			if partSize > 0 {
+				uploader.PartSize = partSize
+			}
+			if concurrencyPerFile > 0 {
+				uploader.Concurrency = concurrencyPerFile
+			}
+		},
+	}
+
+	return s3blob.OpenBucket(ctx, sess, u.Host, opts)
+}
+
+// IsS3Bucket reports whether bucketURL targets the S3 driver, the only
+// backend CloudFront invalidation applies to.
+func IsS3Bucket(bucketURL string) bool {
+	return strings.HasPrefix(bucketURL, "s3://")
+}
+
+// BucketName extracts the bare bucket name from a gocloud bucket URL, used
+// for CloudFront distribution lookups which are keyed by S3 bucket name.
+func BucketName(bucketURL string) string {
+	u, err := url.Parse(bucketURL)
+	if err != nil {
+		return bucketURL
+	}
+	return u.Host
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/ryanuber/go-glob"
+	"gopkg.in/yaml.v2"
+)
+
+const defaultCacheControl = "max-age=900"
+const defaultACL = "public-read"
+
+var configNames = []string{".aws-site-manager.yaml", ".aws-site-manager.yml", ".aws-site-manager.json"}
+
+type PathRule struct {
+	Pattern      string `yaml:"pattern" json:"pattern"`
+	CacheControl string `yaml:"cache_control" json:"cache_control"`
+	ACL          string `yaml:"acl" json:"acl"`
+	// ContentEncoding forces the upload's Content-Encoding header. "gzip" and
+	// "br" also make UploadFileHandler compress the body with that codec,
+	// overriding the automatic CompressBest choice. Any other value is taken
+	// to mean the file on disk is already encoded that way and is uploaded
+	// unmodified under that label.
+	ContentEncoding string `yaml:"content_encoding" json:"content_encoding"`
+	ContentType     string `yaml:"content_type" json:"content_type"`
+}
+
+type Config struct {
+	Rules []PathRule `yaml:"rules" json:"rules"`
+}
+
+// LoadConfig reads .aws-site-manager.yaml/.yml/.json from the sync root, if present.
+// A missing config file is not an error; callers get the zero-value Config.
+func LoadConfig(root string) (*Config, error) {
+	for _, name := range configNames {
+		data, err := ioutil.ReadFile(filepath.Join(root, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		cfg := &Config{}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, err
+		}
+		return cfg, nil
+	}
+
+	return &Config{}, nil
+}
+
+// Match returns the upload rule for key, applying every matching pattern in
+// order and falling back to the tool's defaults for anything left unset.
+func (c *Config) Match(key string) PathRule {
+	rule := PathRule{
+		CacheControl: defaultCacheControl,
+		ACL:          defaultACL,
+	}
+
+	for _, r := range c.Rules {
+		if !glob.Glob(r.Pattern, key) {
+			continue
+		}
+
+		if r.CacheControl != "" {
+			rule.CacheControl = r.CacheControl
+		}
+		if r.ACL != "" {
+			rule.ACL = r.ACL
+		}
+		if r.ContentEncoding != "" {
+			rule.ContentEncoding = r.ContentEncoding
+		}
+		if r.ContentType != "" {
+			rule.ContentType = r.ContentType
+		}
+	}
+
+	return rule
+}